@@ -0,0 +1,177 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"encoding/gob"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/rpc"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// init registers every concrete storage.Request type that can appear
+// in a BatchRequest's Requests slice. The slice's static element type
+// is the storage.Request interface, and gob — the codec the real RPC
+// client and server use — can only encode an interface value if its
+// concrete type was registered first; without this, a Node.Batch call
+// carrying a real request fails at the first attempt to marshal it,
+// not at compile time.
+func init() {
+	gob.Register(&storage.ContainsRequest{})
+	gob.Register(&storage.GetRequest{})
+	gob.Register(&storage.PutRequest{})
+	gob.Register(&storage.IncrementRequest{})
+	gob.Register(&storage.DeleteRequest{})
+	gob.Register(&storage.DeleteRangeRequest{})
+	gob.Register(&storage.ScanRequest{})
+	gob.Register(&storage.EndTransactionRequest{})
+}
+
+// responsePtr constrains RP to be a pointer to Resp that also
+// implements storage.Response. It's the standard "pointer receiver
+// implements the interface" generics idiom, and lets sendRPC allocate
+// a zero Resp and report an error on it through a plain method call
+// instead of reflect.Value.FieldByName.
+type responsePtr[Resp any] interface {
+	*Resp
+	storage.Response
+}
+
+// sendRPC sends the specified RPC asynchronously and returns a
+// channel which receives the populated response when the call
+// completes. It retries on stale-descriptor errors against a
+// corrected range cache entry (see evictOnError), up to
+// maxSendRPCRetries times with exponential backoff, all bounded by
+// sendRPCTimeout — replacing the reflect.MakeChan/FieldByName("Error")
+// this used to require with a type parameter, so a mismatched
+// response type is a compile error instead of a runtime panic.
+func sendRPC[Req any, Resp any, RP responsePtr[Resp]](
+	db *DistDB, key storage.Key, method string, args *Req) <-chan RP {
+	replyChan := make(chan RP, 1)
+
+	go func() {
+		deadline := time.Now().Add(sendRPCTimeout)
+		backoff := sendRPCInitialBackoff
+
+		for attempt := 0; ; attempt++ {
+			reply := RP(new(Resp))
+			node, err := db.getNode(key)
+			if err == nil {
+				err = callWithDeadline(node, method, args, reply, deadline)
+			}
+
+			if err == nil {
+				replyChan <- reply
+				return
+			}
+
+			if !db.evictOnError(key, err) || attempt >= maxSendRPCRetries || time.Now().After(deadline) {
+				reply.SetError(err)
+				replyChan <- reply
+				return
+			}
+
+			atomic.AddInt64(&rpcRetryCount, 1)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}()
+
+	return replyChan
+}
+
+// callWithDeadline runs node.Call in its own goroutine and waits for
+// it only until deadline, so a single hung RPC — one that neither
+// returns nor errors — can't block sendRPC's retry loop forever the
+// way a bare node.Call would. The goroutine is abandoned, not killed,
+// if deadline elapses first: net/rpc gives no way to cancel a call
+// already in flight, but bounding how long a caller waits on it is
+// enough to make the per-request deadline real.
+func callWithDeadline(node *rpc.Client, method string, args, reply interface{}, deadline time.Time) error {
+	done := make(chan error, 1)
+	go func() { done <- node.Call(method, args, reply) }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(time.Until(deadline)):
+		return util.Errorf("rpc %s to %v timed out", method, node)
+	}
+}
+
+// Batch packs multiple heterogeneous sub-requests destined for the
+// same range into a single Node.Batch RPC. Sub-requests are grouped
+// by the range that owns their key (via the range cache) and each
+// group is sent as one RPC in parallel with the others, bounded by
+// maxConcurrentRangeRPCs. This collapses common patterns like
+// Put+Put+EndTransaction — which would otherwise cost one round trip
+// per sub-request — into a single round trip per range.
+func (db *DistDB) Batch(args *storage.BatchRequest) <-chan *storage.BatchResponse {
+	replyChan := make(chan *storage.BatchResponse, 1)
+
+	go func() {
+		groups := map[string][]storage.Request{}
+		starts := map[string]storage.Key{}
+
+		for _, req := range args.Requests {
+			rng, err := db.rangeDescriptorForKey(req.Header().Key)
+			if err != nil {
+				replyChan <- &storage.BatchResponse{Error: err}
+				return
+			}
+			start := string(rng.StartKey)
+			groups[start] = append(groups[start], req)
+			starts[start] = rng.StartKey
+		}
+
+		results := make(chan *storage.BatchResponse, len(groups))
+		sem := make(chan struct{}, maxConcurrentRangeRPCs)
+		var wg sync.WaitGroup
+
+		for start, reqs := range groups {
+			wg.Add(1)
+			go func(start string, reqs []storage.Request) {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+
+				rngArgs := &storage.BatchRequest{Requests: reqs}
+				rawChan := sendRPC[storage.BatchRequest, storage.BatchResponse, *storage.BatchResponse](
+					db, starts[start], "Node.Batch", rngArgs)
+				results <- <-rawChan
+			}(start, reqs)
+		}
+		go func() {
+			wg.Wait()
+			close(results)
+		}()
+
+		agg := &storage.BatchResponse{}
+		for reply := range results {
+			if reply.Error != nil && agg.Error == nil {
+				agg.Error = reply.Error
+			}
+			agg.Responses = append(agg.Responses, reply.Responses...)
+		}
+		replyChan <- agg
+	}()
+
+	return replyChan
+}
@@ -0,0 +1,65 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// BenchmarkSendRPC measures the allocations of a single round trip
+// through the generic sendRPC, which replaced the old
+// reflect.MakeChan/FieldByName("Error") implementation specifically
+// to get this off the allocator's critical path.
+func BenchmarkSendRPC(b *testing.B) {
+	db := newTestDB(b)
+	seedRange(b, db, "a", "z", &fakeNode{})
+
+	args := &storage.GetRequest{Key: storage.Key("a1")}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reply := <-db.Get(args)
+		if reply.Error != nil {
+			b.Fatalf("unexpected error: %s", reply.Error)
+		}
+	}
+}
+
+// BenchmarkBatch measures packing several sub-requests destined for
+// the same range into one Node.Batch RPC, the pattern Batch exists to
+// collapse into a single round trip instead of one per sub-request.
+func BenchmarkBatch(b *testing.B) {
+	db := newTestDB(b)
+	seedRange(b, db, "a", "z", &fakeNode{})
+
+	args := &storage.BatchRequest{Requests: []storage.Request{
+		&storage.PutRequest{Key: storage.Key("a1")},
+		&storage.PutRequest{Key: storage.Key("a2")},
+		&storage.EndTransactionRequest{Keys: []storage.Key{storage.Key("a1"), storage.Key("a2")}},
+	}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reply := <-db.Batch(args)
+		if reply.Error != nil {
+			b.Fatalf("unexpected error: %s", reply.Error)
+		}
+	}
+}
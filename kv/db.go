@@ -18,12 +18,11 @@
 package kv
 
 import (
-	"reflect"
-
 	"github.com/cockroachdb/cockroach/gossip"
 	"github.com/cockroachdb/cockroach/rpc"
 	"github.com/cockroachdb/cockroach/storage"
 	"github.com/cockroachdb/cockroach/util"
+	"golang.org/x/net/context"
 )
 
 // A DB interface provides asynchronous methods to access a key value store.
@@ -34,12 +33,17 @@ type DB interface {
 	Increment(args *storage.IncrementRequest) <-chan *storage.IncrementResponse
 	Delete(args *storage.DeleteRequest) <-chan *storage.DeleteResponse
 	DeleteRange(args *storage.DeleteRangeRequest) <-chan *storage.DeleteRangeResponse
-	Scan(args *storage.ScanRequest) <-chan *storage.ScanResponse
+	Scan(ctx context.Context, args *storage.ScanRequest) <-chan *storage.ScanResponse
 	EndTransaction(args *storage.EndTransactionRequest) <-chan *storage.EndTransactionResponse
+	Batch(args *storage.BatchRequest) <-chan *storage.BatchResponse
 	AccumulateTS(args *storage.AccumulateTSRequest) <-chan *storage.AccumulateTSResponse
 	ReapQueue(args *storage.ReapQueueRequest) <-chan *storage.ReapQueueResponse
 	EnqueueUpdate(args *storage.EnqueueUpdateRequest) <-chan *storage.EnqueueUpdateResponse
 	EnqueueMessage(args *storage.EnqueueMessageRequest) <-chan *storage.EnqueueMessageResponse
+	// Close releases the resources held by the DB, including any
+	// pooled connections and background goroutines. It must be called
+	// once the DB is no longer needed.
+	Close()
 }
 
 // A DistDB provides methods to access Cockroach's monolithic,
@@ -54,13 +58,20 @@ type DistDB struct {
 	// rangeCache caches replica metadata for key ranges. The cache is
 	// filled while servicing read and write requests to the key value
 	// store.
-	rangeCache util.LRUCache
+	rangeCache *rangeDescriptorCache
+	// nodes is a connection-pooled, health-checked registry of RPC
+	// clients keyed by node address, backing getNode.
+	nodes *nodeRegistry
 }
 
 // NewDB returns a key-value datastore client which connects to the
 // Cockroach cluster via the supplied gossip instance.
 func NewDB(gossip *gossip.Gossip) DB {
-	return &DistDB{gossip: gossip}
+	return &DistDB{
+		gossip:     gossip,
+		rangeCache: newRangeDescriptorCache(),
+		nodes:      newNodeRegistry(gossip),
+	}
 }
 
 // getNode gets an RPC client to the node where the requested
@@ -69,81 +80,171 @@ func NewDB(gossip *gossip.Gossip) DB {
 // cache doesn't contain range metadata corresponding to the specified
 // key.
 func (db *DistDB) getNode(key storage.Key) (*rpc.Client, error) {
-	return nil, util.Errorf("getNode unimplemented")
+	rng, err := db.rangeDescriptorForKey(key)
+	if err != nil {
+		return nil, err
+	}
+	client, err := db.nodes.clientFor(rng.Leader.Address)
+	db.nodes.recordResult(rng.Leader.Address, err)
+	return client, err
 }
 
-// sendRPC sends the specified RPC asynchronously and returns a
-// channel which receives the reply struct when the call is
-// complete. Returns a channel of the same type as "reply".
-func (db *DistDB) sendRPC(key storage.Key, method string, args, reply interface{}) interface{} {
-	chanVal := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, reflect.TypeOf(reply)), 1)
+// Close tears down db's node registry: its background gossip-watching
+// and liveness-probing goroutines are stopped and every pooled
+// connection is closed. Callers that create a DistDB must Close it
+// when done, or those goroutines and connections leak for the
+// lifetime of the process.
+func (db *DistDB) Close() {
+	db.nodes.stop()
+}
 
-	go func() {
-		replyVal := reflect.ValueOf(reply)
-		node, err := db.getNode(key)
-		if err == nil {
-			err = node.Call(method, args, reply)
-		}
-		if err != nil {
-			// TODO(spencer): check error here; we need to clear this
-			// segment of range cache and retry getNode() if the range
-			// wasn't found.
-			reflect.Indirect(replyVal).FieldByName("Error").Set(reflect.ValueOf(err))
-		}
-		chanVal.Send(replyVal)
-	}()
+// rangeDescriptorForKey returns the range descriptor used to route
+// key. A cache hit is the cached range containing key. On a cache miss it
+// falls back to the first range's descriptor as gossiped by the
+// cluster (gossip.KeyFirstRangeDescriptor); that descriptor is
+// returned without checking that it covers key. The resolved
+// descriptor is added to the cache so subsequent lookups for keys in
+// the same range avoid the gossip round trip.
+func (db *DistDB) rangeDescriptorForKey(key storage.Key) (*storage.RangeDescriptor, error) {
+	if rng, ok := db.rangeCache.lookup(key); ok {
+		return rng, nil
+	}
 
-	return chanVal.Interface()
+	info, err := db.gossip.GetInfo(gossip.KeyFirstRangeDescriptor)
+	if err != nil {
+		return nil, util.Errorf("unable to resolve range for key %q: %s", key, err)
+	}
+	rng, ok := info.(*storage.RangeDescriptor)
+	if !ok {
+		return nil, util.Errorf("gossip info for key %q is not a range descriptor", key)
+	}
+
+	db.rangeCache.insert(rng)
+	return rng, nil
 }
 
+// sendRPC sends the specified RPC asynchronously and returns a
+// channel which receives the populated response when the call
+// completes; see batch.go for the generic implementation shared by
+// every method below.
+
 // Contains checks for the existence of a key.
 func (db *DistDB) Contains(args *storage.ContainsRequest) <-chan *storage.ContainsResponse {
-	return db.sendRPC(args.Key, "Node.Contains",
-		args, &storage.ContainsResponse{}).(chan *storage.ContainsResponse)
+	return sendRPC[storage.ContainsRequest, storage.ContainsResponse, *storage.ContainsResponse](
+		db, args.Key, "Node.Contains", args)
 }
 
 // Get.
 func (db *DistDB) Get(args *storage.GetRequest) <-chan *storage.GetResponse {
-	return db.sendRPC(args.Key, "Node.Get",
-		args, &storage.GetResponse{}).(chan *storage.GetResponse)
+	return sendRPC[storage.GetRequest, storage.GetResponse, *storage.GetResponse](
+		db, args.Key, "Node.Get", args)
 }
 
 // Put.
 func (db *DistDB) Put(args *storage.PutRequest) <-chan *storage.PutResponse {
-	return db.sendRPC(args.Key, "Node.Put",
-		args, &storage.PutResponse{}).(chan *storage.PutResponse)
+	return sendRPC[storage.PutRequest, storage.PutResponse, *storage.PutResponse](
+		db, args.Key, "Node.Put", args)
 }
 
 // Increment.
 func (db *DistDB) Increment(args *storage.IncrementRequest) <-chan *storage.IncrementResponse {
-	return db.sendRPC(args.Key, "Node.Increment",
-		args, &storage.IncrementResponse{}).(chan *storage.IncrementResponse)
+	return sendRPC[storage.IncrementRequest, storage.IncrementResponse, *storage.IncrementResponse](
+		db, args.Key, "Node.Increment", args)
 }
 
 // Delete.
 func (db *DistDB) Delete(args *storage.DeleteRequest) <-chan *storage.DeleteResponse {
-	return db.sendRPC(args.Key, "Node.Delete",
-		args, &storage.DeleteResponse{}).(chan *storage.DeleteResponse)
+	return sendRPC[storage.DeleteRequest, storage.DeleteResponse, *storage.DeleteResponse](
+		db, args.Key, "Node.Delete", args)
 }
 
-// DeleteRange.
-func (db *DistDB) DeleteRange(args *storage.DeleteRangeRequest) <-chan *storage.DeleteRangeResponse {
-	// TODO(spencer): range of keys.
-	return db.sendRPC(args.StartKey, "Node.DeleteRange",
-		args, &storage.DeleteRangeResponse{}).(chan *storage.DeleteRangeResponse)
-}
+// DeleteRange and EndTransaction are implemented in multi_range.go,
+// since both may need to fan a single logical request out across
+// several ranges.
 
-// Scan.
-func (db *DistDB) Scan(args *storage.ScanRequest) <-chan *storage.ScanResponse {
-	// TODO(spencer): range of keys.
-	return nil
-}
+// Scan scans the key range [args.Key, args.EndKey), returning up to
+// args.MaxResults key/value pairs (no limit if MaxResults is zero).
+// Because a scan's key span may cover many ranges, results are
+// streamed back one range at a time on the returned channel rather
+// than being assembled in full before replying: Scan resolves the
+// range owning the current key via the range cache (falling back to
+// gossip on a miss), issues a Node.Scan RPC against it, and blocks
+// sending the partial response until the caller receives it before
+// moving on to the next range. That send is the only buffering in
+// the pipeline, so a slow consumer never causes more than one
+// range's worth of rows to be held in memory. The channel is closed
+// when EndKey is reached, MaxResults is satisfied, or ctx is done; a
+// final response with Error set precedes the close on failure.
+func (db *DistDB) Scan(ctx context.Context, args *storage.ScanRequest) <-chan *storage.ScanResponse {
+	replyChan := make(chan *storage.ScanResponse)
+
+	go func() {
+		defer close(replyChan)
+
+		key := args.Key
+		remaining := args.MaxResults
+
+		for key.Less(args.EndKey) {
+			select {
+			case <-ctx.Done():
+				replyChan <- &storage.ScanResponse{Error: ctx.Err()}
+				return
+			default:
+			}
+
+			rng, err := db.rangeDescriptorForKey(key)
+			if err != nil {
+				replyChan <- &storage.ScanResponse{Error: err}
+				return
+			}
+
+			rngArgs := *args
+			rngArgs.Key = key
+			if rng.EndKey.Less(args.EndKey) {
+				rngArgs.EndKey = rng.EndKey
+			}
+			if args.MaxResults > 0 {
+				rngArgs.MaxResults = remaining
+			}
+
+			rawChan := sendRPC[storage.ScanRequest, storage.ScanResponse, *storage.ScanResponse](
+				db, key, "Node.Scan", &rngArgs)
+			reply := <-rawChan
+
+			if reply.Error != nil {
+				// sendRPC already retries stale-descriptor errors against a
+				// corrected range cache entry, so an error surfacing here is
+				// terminal for the scan.
+				replyChan <- reply
+				return
+			}
+
+			select {
+			case replyChan <- reply:
+			case <-ctx.Done():
+				return
+			}
+
+			if args.MaxResults > 0 {
+				remaining -= int64(len(reply.Rows))
+				if remaining <= 0 {
+					return
+				}
+			}
+
+			// A range may truncate its own response before reaching
+			// rngArgs.EndKey (e.g. to bound a single RPC's size); when it
+			// does, ResumeKey says where to pick up within the same range
+			// instead of skipping ahead to the next one.
+			if reply.ResumeKey != nil {
+				key = reply.ResumeKey
+			} else {
+				key = rngArgs.EndKey
+			}
+		}
+	}()
 
-// EndTransaction.
-func (db *DistDB) EndTransaction(args *storage.EndTransactionRequest) <-chan *storage.EndTransactionResponse {
-	// TODO(spencer): multiple keys here...
-	return db.sendRPC(args.Keys[0], "Node.EndTransaction",
-		args, &storage.EndTransactionResponse{}).(chan *storage.EndTransactionResponse)
+	return replyChan
 }
 
 // AccumulateTS is used to efficiently accumulate a time series of
@@ -151,8 +252,8 @@ func (db *DistDB) EndTransaction(args *storage.EndTransactionRequest) <-chan *st
 // key/value might represent a minute of data. Each would contain 60
 // int64 counts, each representing a second.
 func (db *DistDB) AccumulateTS(args *storage.AccumulateTSRequest) <-chan *storage.AccumulateTSResponse {
-	return db.sendRPC(args.Key, "Node.AccumulateTS",
-		args, &storage.AccumulateTSResponse{}).(chan *storage.AccumulateTSResponse)
+	return sendRPC[storage.AccumulateTSRequest, storage.AccumulateTSResponse, *storage.AccumulateTSResponse](
+		db, args.Key, "Node.AccumulateTS", args)
 }
 
 // ReapQueue scans and deletes messages from a recipient message
@@ -161,8 +262,8 @@ func (db *DistDB) AccumulateTS(args *storage.AccumulateTSRequest) <-chan *storag
 // the requested maximum. If fewer than the maximum were returned,
 // then the queue is empty.
 func (db *DistDB) ReapQueue(args *storage.ReapQueueRequest) <-chan *storage.ReapQueueResponse {
-	return db.sendRPC(args.Inbox, "Node.ReapQueue",
-		args, &storage.ReapQueueResponse{}).(chan *storage.ReapQueueResponse)
+	return sendRPC[storage.ReapQueueRequest, storage.ReapQueueResponse, *storage.ReapQueueResponse](
+		db, args.Inbox, "Node.ReapQueue", args)
 }
 
 // EnqueueUpdate enqueues an update for eventual execution.
@@ -173,6 +274,6 @@ func (db *DistDB) EnqueueUpdate(args *storage.EnqueueUpdateRequest) <-chan *stor
 
 // EnqueueMessage enqueues a message for delivery to an inbox.
 func (db *DistDB) EnqueueMessage(args *storage.EnqueueMessageRequest) <-chan *storage.EnqueueMessageResponse {
-	return db.sendRPC(args.Inbox, "Node.EnqueueMessage",
-		args, &storage.EnqueueMessageResponse{}).(chan *storage.EnqueueMessageResponse)
+	return sendRPC[storage.EnqueueMessageRequest, storage.EnqueueMessageResponse, *storage.EnqueueMessageResponse](
+		db, args.Inbox, "Node.EnqueueMessage", args)
 }
@@ -0,0 +1,208 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"sync"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// maxConcurrentRangeRPCs bounds the number of Node RPCs a single
+// multi-range request keeps in flight at once.
+const maxConcurrentRangeRPCs = 8
+
+// rangesForSpan returns the descriptors for every range overlapping
+// [startKey, endKey), in key order. The first range is resolved via
+// rangeDescriptorForKey using startKey and each later one using the
+// end key of the previous one, so the walk benefits from the range cache exactly as
+// Scan's does.
+func (db *DistDB) rangesForSpan(startKey, endKey storage.Key) ([]*storage.RangeDescriptor, error) {
+	var ranges []*storage.RangeDescriptor
+	key := startKey
+	for key.Less(endKey) {
+		rng, err := db.rangeDescriptorForKey(key)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, rng)
+		if !rng.EndKey.Less(endKey) {
+			break
+		}
+		key = rng.EndKey
+	}
+	return ranges, nil
+}
+
+// DeleteRange deletes the keys in [args.StartKey, args.EndKey), which
+// may span multiple ranges. A Node.DeleteRange RPC is issued to each
+// overlapping range concurrently, bounded by maxConcurrentRangeRPCs,
+// and the per-range responses are merged into a single response: the
+// deleted-key counts are summed and the first error encountered, if
+// any, is reported.
+func (db *DistDB) DeleteRange(args *storage.DeleteRangeRequest) <-chan *storage.DeleteRangeResponse {
+	replyChan := make(chan *storage.DeleteRangeResponse, 1)
+
+	go func() {
+		ranges, err := db.rangesForSpan(args.StartKey, args.EndKey)
+		if err != nil {
+			replyChan <- &storage.DeleteRangeResponse{Error: err}
+			return
+		}
+
+		// Narrow each range's sub-request to the span it actually owns
+		// within [args.StartKey, args.EndKey), the same way Scan walks
+		// ranges with a cursor in db.go: the first range may start
+		// before args.StartKey (the span needn't begin on a range
+		// boundary), so its sub-request starts at the cursor rather
+		// than at rng.StartKey. Every later range's StartKey already
+		// equals the advancing cursor, since rangesForSpan enumerates
+		// them contiguously.
+		key := args.StartKey
+		results := make(chan *storage.DeleteRangeResponse, len(ranges))
+		sem := make(chan struct{}, maxConcurrentRangeRPCs)
+		var wg sync.WaitGroup
+
+		for _, rng := range ranges {
+			startKey := key
+			endKey := args.EndKey
+			if rng.EndKey.Less(args.EndKey) {
+				endKey = rng.EndKey
+			}
+			key = endKey
+
+			wg.Add(1)
+			go func(rng *storage.RangeDescriptor, startKey, endKey storage.Key) {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+
+				rngArgs := *args
+				rngArgs.StartKey = startKey
+				rngArgs.EndKey = endKey
+
+				rawChan := sendRPC[storage.DeleteRangeRequest, storage.DeleteRangeResponse, *storage.DeleteRangeResponse](
+					db, rng.StartKey, "Node.DeleteRange", &rngArgs)
+				results <- <-rawChan
+			}(rng, startKey, endKey)
+		}
+
+		go func() {
+			wg.Wait()
+			close(results)
+		}()
+
+		agg := &storage.DeleteRangeResponse{}
+		for reply := range results {
+			if reply.Error != nil && agg.Error == nil {
+				agg.Error = reply.Error
+				continue
+			}
+			agg.NumDeleted += reply.NumDeleted
+		}
+		replyChan <- agg
+	}()
+
+	return replyChan
+}
+
+// EndTransaction finalizes a transaction whose writes may have landed
+// on multiple ranges. It runs a two-phase commit across every range
+// touched by args.Keys: first a Node.EndTransactionPrepare RPC to
+// each range's leader in parallel, and only once every range has
+// prepared successfully, a Node.EndTransactionCommit RPC to each of
+// them. If any range fails to prepare, a Node.EndTransactionRollback
+// RPC is sent to every range touched by args.Keys (including the ones
+// whose prepare failed) and the first prepare error is returned
+// instead of a committed response.
+func (db *DistDB) EndTransaction(args *storage.EndTransactionRequest) <-chan *storage.EndTransactionResponse {
+	replyChan := make(chan *storage.EndTransactionResponse, 1)
+
+	go func() {
+		rangeStarts := map[string]storage.Key{}
+		rangeKeys := map[string][]storage.Key{}
+		for _, key := range args.Keys {
+			rng, err := db.rangeDescriptorForKey(key)
+			if err != nil {
+				replyChan <- &storage.EndTransactionResponse{Error: err}
+				return
+			}
+			start := string(rng.StartKey)
+			rangeStarts[start] = rng.StartKey
+			rangeKeys[start] = append(rangeKeys[start], key)
+		}
+
+		phase := func(method string) map[string]*storage.EndTransactionResponse {
+			type keyedReply struct {
+				start string
+				reply *storage.EndTransactionResponse
+			}
+			results := make(chan keyedReply, len(rangeStarts))
+			sem := make(chan struct{}, maxConcurrentRangeRPCs)
+			var wg sync.WaitGroup
+
+			for start, key := range rangeStarts {
+				wg.Add(1)
+				go func(start string, key storage.Key) {
+					defer wg.Done()
+					sem <- struct{}{}
+					defer func() { <-sem }()
+
+					rngArgs := *args
+					rngArgs.Keys = rangeKeys[start]
+					rawChan := sendRPC[storage.EndTransactionRequest, storage.EndTransactionResponse, *storage.EndTransactionResponse](
+						db, key, method, &rngArgs)
+					results <- keyedReply{start: start, reply: <-rawChan}
+				}(start, key)
+			}
+			go func() {
+				wg.Wait()
+				close(results)
+			}()
+
+			out := make(map[string]*storage.EndTransactionResponse, len(rangeStarts))
+			for r := range results {
+				out[r.start] = r.reply
+			}
+			return out
+		}
+
+		prepared := phase("Node.EndTransactionPrepare")
+
+		var firstErr error
+		for _, reply := range prepared {
+			if reply.Error != nil && firstErr == nil {
+				firstErr = reply.Error
+			}
+		}
+		if firstErr != nil {
+			phase("Node.EndTransactionRollback")
+			replyChan <- &storage.EndTransactionResponse{Error: firstErr}
+			return
+		}
+
+		agg := &storage.EndTransactionResponse{}
+		for _, reply := range phase("Node.EndTransactionCommit") {
+			if reply.Error != nil && agg.Error == nil {
+				agg.Error = reply.Error
+			}
+			agg.Intents = append(agg.Intents, reply.Intents...)
+		}
+		replyChan <- agg
+	}()
+
+	return replyChan
+}
@@ -0,0 +1,130 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// TestDeleteRangeMidSpan checks that a DeleteRange spanning a split
+// point is fanned out to every range it overlaps, each scoped to its
+// own sub-span, and that the per-range counts are summed.
+func TestDeleteRangeMidSpan(t *testing.T) {
+	db := newTestDB(t)
+
+	var mu sync.Mutex
+	var spans [][2]string
+	record := func(numDeleted int64) func(args *storage.DeleteRangeRequest, reply *storage.DeleteRangeResponse) error {
+		return func(args *storage.DeleteRangeRequest, reply *storage.DeleteRangeResponse) error {
+			mu.Lock()
+			spans = append(spans, [2]string{string(args.StartKey), string(args.EndKey)})
+			mu.Unlock()
+			reply.NumDeleted = numDeleted
+			return nil
+		}
+	}
+	seedRange(t, db, "a", "m", &fakeNode{delRangeFn: record(3)})
+	seedRange(t, db, "m", "z", &fakeNode{delRangeFn: record(5)})
+
+	reply := <-db.DeleteRange(&storage.DeleteRangeRequest{StartKey: storage.Key("f"), EndKey: storage.Key("t")})
+	if reply.Error != nil {
+		t.Fatalf("unexpected error: %s", reply.Error)
+	}
+	if reply.NumDeleted != 8 {
+		t.Fatalf("got NumDeleted %d, want 8", reply.NumDeleted)
+	}
+
+	want := map[[2]string]bool{{"f", "m"}: true, {"m", "t"}: true}
+	if len(spans) != 2 {
+		t.Fatalf("got %d per-range RPCs, want 2: %v", len(spans), spans)
+	}
+	for _, s := range spans {
+		if !want[s] {
+			t.Errorf("unexpected per-range span %v, want one of %v", s, want)
+		}
+	}
+}
+
+// TestEndTransactionKeysNarrowed checks that each range's prepare RPC
+// only receives the keys that range actually owns, not the
+// transaction's full key set.
+func TestEndTransactionKeysNarrowed(t *testing.T) {
+	db := newTestDB(t)
+
+	var mu sync.Mutex
+	seen := map[string][]string{}
+	prepare := func(rangeName string) func(args *storage.EndTransactionRequest, reply *storage.EndTransactionResponse) error {
+		return func(args *storage.EndTransactionRequest, reply *storage.EndTransactionResponse) error {
+			mu.Lock()
+			for _, k := range args.Keys {
+				seen[rangeName] = append(seen[rangeName], string(k))
+			}
+			mu.Unlock()
+			return nil
+		}
+	}
+	seedRange(t, db, "a", "m", &fakeNode{prepareFn: prepare("am")})
+	seedRange(t, db, "m", "z", &fakeNode{prepareFn: prepare("mz")})
+
+	args := &storage.EndTransactionRequest{Keys: []storage.Key{
+		storage.Key("a1"), storage.Key("a2"), storage.Key("m1"),
+	}}
+	reply := <-db.EndTransaction(args)
+	if reply.Error != nil {
+		t.Fatalf("unexpected error: %s", reply.Error)
+	}
+
+	if got := seen["am"]; len(got) != 2 {
+		t.Errorf("range [a,m) saw keys %v, want exactly a1 and a2", got)
+	}
+	if got := seen["mz"]; len(got) != 1 || got[0] != "m1" {
+		t.Errorf("range [m,z) saw keys %v, want exactly m1", got)
+	}
+}
+
+// TestEndTransactionCommitFailureAggregates checks that a simulated
+// node failure during the commit phase surfaces as the aggregated
+// response's Error rather than being silently swallowed, and that
+// the range whose commit succeeded was still committed.
+func TestEndTransactionCommitFailureAggregates(t *testing.T) {
+	db := newTestDB(t)
+
+	var otherCommitted bool
+	seedRange(t, db, "a", "m", &fakeNode{
+		commitFn: func(args *storage.EndTransactionRequest, reply *storage.EndTransactionResponse) error {
+			otherCommitted = true
+			return nil
+		},
+	})
+	seedRange(t, db, "m", "z", &fakeNode{
+		commitFn: func(args *storage.EndTransactionRequest, reply *storage.EndTransactionResponse) error {
+			return util.Errorf("node unavailable during commit")
+		},
+	})
+
+	args := &storage.EndTransactionRequest{Keys: []storage.Key{storage.Key("a1"), storage.Key("m1")}}
+	reply := <-db.EndTransaction(args)
+	if reply.Error == nil {
+		t.Fatalf("expected an aggregated commit error, got a successful reply")
+	}
+	if !otherCommitted {
+		t.Fatalf("the range that didn't fail should still have been committed")
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/rpc"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+const (
+	// connsPerNode is the number of parallel RPC connections the
+	// registry keeps open to each node; calls are round-robined across
+	// them so one slow connection can't head-of-line block every
+	// outstanding request to that node.
+	connsPerNode = 4
+	// nodePingInterval is how often the registry probes each pooled
+	// node for liveness in the background, independent of application
+	// traffic.
+	nodePingInterval = 3 * time.Second
+	// breakerThreshold is the number of consecutive RPC errors on a
+	// node after which the circuit breaker opens for that node.
+	breakerThreshold = 5
+	// breakerCooldown is how long a tripped breaker stays open before
+	// the registry allows another attempt against the node.
+	breakerCooldown = 10 * time.Second
+)
+
+// nodeConn is a pool of connections to a single node, plus the state
+// needed to drive liveness probing and the circuit breaker.
+type nodeConn struct {
+	addr string
+
+	mu    sync.Mutex
+	conns []*rpc.Client
+	next  int
+
+	brokenUntil     time.Time
+	consecutiveErrs int32
+}
+
+// nodeRegistry is a cached, connection-pooled, health-checked
+// registry of RPC clients keyed by node address. It backs
+// DistDB.getNode. A nodeRegistry subscribes to gossip so it can
+// pre-warm connections to newly discovered nodes and tear down
+// connections to ones that have left the cluster.
+type nodeRegistry struct {
+	gossip *gossip.Gossip
+
+	mu    sync.Mutex
+	nodes map[string]*nodeConn
+
+	stopper chan struct{}
+}
+
+// newNodeRegistry returns a registry that watches g for node
+// descriptor updates and begins background liveness probing.
+func newNodeRegistry(g *gossip.Gossip) *nodeRegistry {
+	nr := &nodeRegistry{
+		gossip:  g,
+		nodes:   map[string]*nodeConn{},
+		stopper: make(chan struct{}),
+	}
+	go nr.watchGossip()
+	go nr.probeLoop()
+	return nr
+}
+
+// clientFor returns a pooled, round-robined *rpc.Client for addr,
+// dialing connsPerNode connections the first time addr is seen. It
+// fails fast if addr's circuit breaker is currently open.
+func (nr *nodeRegistry) clientFor(addr string) (*rpc.Client, error) {
+	nr.mu.Lock()
+	nc, ok := nr.nodes[addr]
+	if !ok {
+		nc = &nodeConn{addr: addr}
+		nr.nodes[addr] = nc
+	}
+	nr.mu.Unlock()
+
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	if !nc.brokenUntil.IsZero() && time.Now().Before(nc.brokenUntil) {
+		return nil, util.Errorf("circuit breaker open for node %s", addr)
+	}
+
+	if len(nc.conns) == 0 {
+		for i := 0; i < connsPerNode; i++ {
+			c, err := rpc.Dial("tcp", addr)
+			if err != nil {
+				return nil, util.Errorf("unable to dial node %s: %s", addr, err)
+			}
+			nc.conns = append(nc.conns, c)
+		}
+	}
+
+	client := nc.conns[nc.next%len(nc.conns)]
+	nc.next++
+	return client, nil
+}
+
+// recordResult updates addr's consecutive-error count, tripping its
+// circuit breaker for breakerCooldown once the count reaches
+// breakerThreshold. A nil err resets the count. Tripping the breaker
+// also closes and forgets the node's pooled connections: they're
+// almost certainly what's producing the errors (a TCP reset from a
+// flapping node, say, rather than a gossip-reported descriptor
+// change), so leaving them in nc.conns would just let clientFor hand
+// the same dead connections back out once the cooldown ends. Clearing
+// them makes clientFor redial fresh ones instead, so health-checking
+// can actually recover a node rather than tripping the breaker
+// forever against connections that never get replaced.
+func (nr *nodeRegistry) recordResult(addr string, err error) {
+	nr.mu.Lock()
+	nc, ok := nr.nodes[addr]
+	nr.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	if err == nil {
+		atomic.StoreInt32(&nc.consecutiveErrs, 0)
+		return
+	}
+
+	if atomic.AddInt32(&nc.consecutiveErrs, 1) >= breakerThreshold {
+		nc.mu.Lock()
+		// An error while the breaker is already open is clientFor's own
+		// fail-fast; it doesn't extend the cooldown.
+		if !time.Now().Before(nc.brokenUntil) {
+			nc.brokenUntil = time.Now().Add(breakerCooldown)
+			for _, c := range nc.conns {
+				c.Close()
+			}
+			nc.conns = nil
+		}
+		nc.mu.Unlock()
+	}
+}
+
+// evict tears down and forgets the connections cached for addr.
+// watchGossip calls it when gossip reports the node has left the
+// cluster; a descriptor update without Removed set does not evict the
+// node's connections.
+func (nr *nodeRegistry) evict(addr string) {
+	nr.mu.Lock()
+	nc, ok := nr.nodes[addr]
+	delete(nr.nodes, addr)
+	nr.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	for _, c := range nc.conns {
+		c.Close()
+	}
+	nc.conns = nil
+}
+
+// watchGossip subscribes to node descriptor updates so the registry
+// can pre-warm connections to newly discovered nodes and tear down
+// connections to nodes no longer in the cluster.
+func (nr *nodeRegistry) watchGossip() {
+	updates := nr.gossip.Subscribe(gossip.KeyNodeDescriptorPrefix)
+	for {
+		select {
+		case info, ok := <-updates:
+			if !ok {
+				return
+			}
+			desc, ok := info.(*storage.NodeDescriptor)
+			if !ok {
+				continue
+			}
+			if desc.Removed {
+				nr.evict(desc.Address)
+				continue
+			}
+			// Pre-warming is best effort; a failed dial here just leaves
+			// the node cold until the next real RPC retries it.
+			nr.clientFor(desc.Address)
+		case <-nr.stopper:
+			return
+		}
+	}
+}
+
+// probeLoop periodically pings every pooled node so a dead node's
+// circuit breaker trips even if no application traffic happens to hit
+// it.
+func (nr *nodeRegistry) probeLoop() {
+	ticker := time.NewTicker(nodePingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			nr.mu.Lock()
+			addrs := make([]string, 0, len(nr.nodes))
+			for addr := range nr.nodes {
+				addrs = append(addrs, addr)
+			}
+			nr.mu.Unlock()
+
+			for _, addr := range addrs {
+				client, err := nr.clientFor(addr)
+				if err == nil {
+					err = client.Call("Node.Ping", &storage.PingRequest{}, &storage.PingResponse{})
+				}
+				nr.recordResult(addr, err)
+			}
+		case <-nr.stopper:
+			return
+		}
+	}
+}
+
+// stop shuts down the registry's background goroutines and closes all
+// pooled connections.
+func (nr *nodeRegistry) stop() {
+	close(nr.stopper)
+
+	nr.mu.Lock()
+	addrs := make([]string, 0, len(nr.nodes))
+	for addr := range nr.nodes {
+		addrs = append(addrs, addr)
+	}
+	nr.mu.Unlock()
+
+	for _, addr := range addrs {
+		nr.evict(addr)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// waitFor polls cond until it's true or timeout elapses, failing the
+// test in the latter case. The registry's gossip-driven churn is
+// asynchronous, so tests need to wait for it rather than assert
+// immediately after publishing an update.
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met within %s", timeout)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestNodeRegistryChurn checks that the registry pre-warms a
+// connection when gossip reports a new node, and tears it down again
+// once gossip reports the node has left the cluster.
+func TestNodeRegistryChurn(t *testing.T) {
+	g := gossip.New(nil)
+	nr := newNodeRegistry(g)
+	defer nr.stop()
+
+	addr, stop := startFakeNode(t, &fakeNode{})
+	defer stop()
+
+	if err := g.AddInfo(gossip.KeyNodeDescriptorPrefix+addr, &storage.NodeDescriptor{Address: addr}, time.Hour); err != nil {
+		t.Fatalf("AddInfo: %s", err)
+	}
+	waitFor(t, time.Second, func() bool {
+		nr.mu.Lock()
+		defer nr.mu.Unlock()
+		_, ok := nr.nodes[addr]
+		return ok
+	})
+
+	if err := g.AddInfo(gossip.KeyNodeDescriptorPrefix+addr, &storage.NodeDescriptor{Address: addr, Removed: true}, time.Hour); err != nil {
+		t.Fatalf("AddInfo: %s", err)
+	}
+	waitFor(t, time.Second, func() bool {
+		nr.mu.Lock()
+		defer nr.mu.Unlock()
+		_, ok := nr.nodes[addr]
+		return !ok
+	})
+}
+
+// TestNodeRegistryStopReleasesResources checks that stop tears down
+// every pooled connection and lets watchGossip/probeLoop exit, so a
+// caller that creates and discards a registry doesn't leak goroutines
+// or file descriptors.
+func TestNodeRegistryStopReleasesResources(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	g := gossip.New(nil)
+	nr := newNodeRegistry(g)
+
+	for i := 0; i < 3; i++ {
+		addr, stop := startFakeNode(t, &fakeNode{})
+		if _, err := nr.clientFor(addr); err != nil {
+			stop()
+			t.Fatalf("clientFor(%s): %s", addr, err)
+		}
+		// The registry has already dialed its own connections to addr;
+		// the listener's Accept goroutine isn't something stop() owns,
+		// so it would otherwise be mistaken for a leak from nr itself.
+		stop()
+	}
+
+	nr.stop()
+
+	nr.mu.Lock()
+	remaining := len(nr.nodes)
+	nr.mu.Unlock()
+	if remaining != 0 {
+		t.Fatalf("stop left %d node entries (and their connections) behind, want 0", remaining)
+	}
+
+	waitFor(t, time.Second, func() bool {
+		// watchGossip and probeLoop should have returned; allow a little
+		// slack for goroutines the test runtime itself schedules.
+		return runtime.NumGoroutine() <= before+2
+	})
+}
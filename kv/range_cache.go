@@ -0,0 +1,122 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+// rangeDescriptorCacheSize bounds the number of range descriptors the
+// cache holds onto at once.
+const rangeDescriptorCacheSize = 1 << 16
+
+// rangeDescriptorCache indexes storage.RangeDescriptors by the end
+// key of the range they describe, so a lookup for an arbitrary point
+// key can find the range containing it rather than requiring an
+// exact match on that end key. util.LRUCache is a plain hash map and
+// can only ever satisfy the latter, which is why entries here live in
+// a slice sorted by EndKey and are located with a binary search for
+// the first entry whose EndKey is greater than the query key (a
+// range's upper bound is exclusive, so equality doesn't qualify) —
+// the smallest range descriptor that could possibly contain it.
+type rangeDescriptorCache struct {
+	mu      sync.Mutex
+	entries []*storage.RangeDescriptor // sorted by EndKey
+}
+
+// newRangeDescriptorCache returns an empty rangeDescriptorCache.
+func newRangeDescriptorCache() *rangeDescriptorCache {
+	return &rangeDescriptorCache{}
+}
+
+// ceilIndex returns the index of the first entry whose EndKey is
+// strictly greater than key, or len(rdc.entries) if every cached
+// range ends at or before key. Callers must hold rdc.mu.
+func (rdc *rangeDescriptorCache) ceilIndex(key storage.Key) int {
+	return sort.Search(len(rdc.entries), func(i int) bool {
+		return key.Less(rdc.entries[i].EndKey)
+	})
+}
+
+// lookup returns the cached descriptor for the range containing key,
+// if the cache holds one.
+func (rdc *rangeDescriptorCache) lookup(key storage.Key) (*storage.RangeDescriptor, bool) {
+	rdc.mu.Lock()
+	defer rdc.mu.Unlock()
+
+	i := rdc.ceilIndex(key)
+	if i == len(rdc.entries) {
+		return nil, false
+	}
+	rng := rdc.entries[i]
+	if key.Less(rng.StartKey) {
+		// The nearest range by EndKey doesn't actually reach back far
+		// enough to cover key: there's a gap in the cache here.
+		return nil, false
+	}
+	return rng, true
+}
+
+// insert adds or replaces the cached descriptor for the range it
+// describes, keeping rdc.entries sorted by EndKey so any key in
+// [StartKey, EndKey) can find it via lookup. Any existing entry whose
+// span overlaps rng's is dropped first, even if its EndKey doesn't
+// match rng's exactly: rng supersedes it (e.g. rng is one half of a
+// split, and the wider pre-split descriptor is still cached under its
+// old, larger EndKey), and leaving the rest of that stale span
+// in the cache would return a lookup for a key in it instead of
+// re-faulting to resolve whatever now actually covers it. If the
+// cache is full after that, the entry with the smallest EndKey is
+// dropped to make room.
+func (rdc *rangeDescriptorCache) insert(rng *storage.RangeDescriptor) {
+	rdc.mu.Lock()
+	defer rdc.mu.Unlock()
+
+	kept := rdc.entries[:0]
+	for _, e := range rdc.entries {
+		if rng.StartKey.Less(e.EndKey) && e.StartKey.Less(rng.EndKey) {
+			continue // overlaps rng; superseded.
+		}
+		kept = append(kept, e)
+	}
+	rdc.entries = kept
+
+	i := rdc.ceilIndex(rng.EndKey)
+	rdc.entries = append(rdc.entries, nil)
+	copy(rdc.entries[i+1:], rdc.entries[i:])
+	rdc.entries[i] = rng
+
+	if len(rdc.entries) > rangeDescriptorCacheSize {
+		rdc.entries = rdc.entries[1:]
+	}
+}
+
+// evict removes the cached descriptor for the range containing key,
+// if any, forcing the next lookup for a key in that span to
+// re-resolve it from gossip.
+func (rdc *rangeDescriptorCache) evict(key storage.Key) {
+	rdc.mu.Lock()
+	defer rdc.mu.Unlock()
+
+	i := rdc.ceilIndex(key)
+	if i == len(rdc.entries) || key.Less(rdc.entries[i].StartKey) {
+		return
+	}
+	rdc.entries = append(rdc.entries[:i], rdc.entries[i+1:]...)
+}
@@ -0,0 +1,78 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+)
+
+const (
+	// maxSendRPCRetries bounds the number of times sendRPC will
+	// re-dispatch a request after a stale-descriptor error before
+	// giving up and returning the error to the caller.
+	maxSendRPCRetries = 3
+	// sendRPCInitialBackoff is the delay before the first retry;
+	// subsequent retries double it.
+	sendRPCInitialBackoff = 50 * time.Millisecond
+	// sendRPCTimeout bounds the total time a single sendRPC call, all
+	// retries included, may take before it gives up.
+	sendRPCTimeout = 10 * time.Second
+)
+
+// rpcRetryCount counts the number of times sendRPC has retried an RPC
+// after a stale-descriptor error, across all DistDB instances in this
+// process. Exposed for monitoring via RPCRetryCount.
+var rpcRetryCount int64
+
+// RPCRetryCount returns the number of sendRPC retries performed so
+// far due to stale-descriptor errors.
+func RPCRetryCount() int64 {
+	return atomic.LoadInt64(&rpcRetryCount)
+}
+
+// evictOnError inspects err for a stale-descriptor condition and
+// corrects the range cache accordingly, returning true if the caller
+// should retry the RPC. A storage.RangeKeyMismatchError means the
+// range has split or merged since it was cached; the node that
+// rejected the request already computed the authoritative descriptor
+// for the key, so it's installed directly instead of being evicted
+// and re-resolved from gossip on the retry. A storage.NotLeaderError
+// means the range is still correct but its leader has changed, so
+// the cached descriptor is replaced with one reflecting the hinted
+// leader instead of being thrown away.
+func (db *DistDB) evictOnError(key storage.Key, err error) bool {
+	switch e := err.(type) {
+	case *storage.RangeKeyMismatchError:
+		if e.Descriptor != nil {
+			db.rangeCache.insert(e.Descriptor)
+		} else {
+			db.rangeCache.evict(key)
+		}
+		return true
+	case *storage.NotLeaderError:
+		if rng, ok := db.rangeCache.lookup(key); ok {
+			hinted := *rng
+			hinted.Leader = e.Leader
+			db.rangeCache.insert(&hinted)
+		}
+		return true
+	default:
+		return false
+	}
+}
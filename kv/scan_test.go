@@ -0,0 +1,160 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"golang.org/x/net/context"
+)
+
+// seedRange registers a fake node serving [start, end) and inserts
+// its descriptor into db's range cache so Scan resolves it without
+// touching gossip.
+func seedRange(t testing.TB, db *DistDB, start, end string, node *fakeNode) {
+	addr, stop := startFakeNode(t, node)
+	t.Cleanup(stop)
+	db.rangeCache.insert(&storage.RangeDescriptor{
+		StartKey: storage.Key(start),
+		EndKey:   storage.Key(end),
+		Leader:   storage.NodeDescriptor{Address: addr},
+	})
+}
+
+// TestScanOrdering walks a key space split across three fake ranges
+// and checks the rows stream back range by range, in key order, with
+// one partial response per range.
+func TestScanOrdering(t *testing.T) {
+	db := newTestDB(t)
+
+	rows := [][]storage.KeyValue{
+		{{Key: storage.Key("a1"), Value: []byte("1")}},
+		{{Key: storage.Key("b1"), Value: []byte("2")}, {Key: storage.Key("b2"), Value: []byte("3")}},
+		{{Key: storage.Key("c1"), Value: []byte("4")}},
+	}
+	seedRange(t, db, "a", "b", &fakeNode{scanFn: func(args *storage.ScanRequest, reply *storage.ScanResponse) error {
+		reply.Rows = rows[0]
+		return nil
+	}})
+	seedRange(t, db, "b", "c", &fakeNode{scanFn: func(args *storage.ScanRequest, reply *storage.ScanResponse) error {
+		reply.Rows = rows[1]
+		return nil
+	}})
+	seedRange(t, db, "c", "d", &fakeNode{scanFn: func(args *storage.ScanRequest, reply *storage.ScanResponse) error {
+		reply.Rows = rows[2]
+		return nil
+	}})
+
+	var got []storage.KeyValue
+	for reply := range db.Scan(context.Background(), &storage.ScanRequest{Key: storage.Key("a"), EndKey: storage.Key("d")}) {
+		if reply.Error != nil {
+			t.Fatalf("unexpected scan error: %s", reply.Error)
+		}
+		got = append(got, reply.Rows...)
+	}
+
+	if len(got) != 4 {
+		t.Fatalf("got %d rows, want 4: %+v", len(got), got)
+	}
+	for i, want := range []string{"a1", "b1", "b2", "c1"} {
+		if string(got[i].Key) != want {
+			t.Errorf("row %d: got key %q, want %q", i, got[i].Key, want)
+		}
+	}
+}
+
+// TestScanResumeKey checks that a range truncating its own reply
+// before reaching the range boundary is resumed within the same
+// range, via ResumeKey, rather than skipping ahead to the next one.
+func TestScanResumeKey(t *testing.T) {
+	db := newTestDB(t)
+
+	var calls int
+	seedRange(t, db, "a", "c", &fakeNode{scanFn: func(args *storage.ScanRequest, reply *storage.ScanResponse) error {
+		calls++
+		switch calls {
+		case 1:
+			reply.Rows = []storage.KeyValue{{Key: storage.Key("a1")}}
+			reply.ResumeKey = storage.Key("a2")
+		case 2:
+			if string(args.Key) != "a2" {
+				t.Errorf("resumed scan: got start key %q, want %q", args.Key, "a2")
+			}
+			reply.Rows = []storage.KeyValue{{Key: storage.Key("a2")}}
+		default:
+			t.Fatalf("unexpected extra call to range [a,c)")
+		}
+		return nil
+	}})
+
+	var got []storage.KeyValue
+	for reply := range db.Scan(context.Background(), &storage.ScanRequest{Key: storage.Key("a"), EndKey: storage.Key("c")}) {
+		if reply.Error != nil {
+			t.Fatalf("unexpected scan error: %s", reply.Error)
+		}
+		got = append(got, reply.Rows...)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d rows, want 2: %+v", len(got), got)
+	}
+	if calls != 2 {
+		t.Fatalf("got %d calls to the resuming range, want 2", calls)
+	}
+}
+
+// TestScanCacheInvalidation checks that a RangeKeyMismatchError
+// (simulating a split since the range was cached) causes the stale
+// cache entry Scan relies on to be replaced with the error's
+// authoritative descriptor, so the next resolution of a key in that
+// span finds the post-split range instead of the stale one. This is
+// the same path sendRPC's retry loop drives via evictOnError before
+// Scan ever sees a reply.
+func TestScanCacheInvalidation(t *testing.T) {
+	db := newTestDB(t)
+
+	seedRange(t, db, "a", "c", &fakeNode{})
+	staleRng, ok := db.rangeCache.lookup(storage.Key("a"))
+	if !ok {
+		t.Fatalf("seeded range not found in cache")
+	}
+
+	newDescriptor := &storage.RangeDescriptor{
+		StartKey: storage.Key("a"),
+		EndKey:   storage.Key("b"),
+		Leader:   staleRng.Leader,
+	}
+	if !db.evictOnError(storage.Key("a"), &storage.RangeKeyMismatchError{Descriptor: newDescriptor}) {
+		t.Fatalf("evictOnError should ask for a retry on a stale-descriptor error")
+	}
+
+	rng, ok := db.rangeCache.lookup(storage.Key("a"))
+	if !ok {
+		t.Fatalf("range cache has no entry for key %q after eviction", "a")
+	}
+	if string(rng.EndKey) != "b" {
+		t.Fatalf("range cache still has the stale descriptor (EndKey %q), want the split's (EndKey %q)", rng.EndKey, "b")
+	}
+
+	// The remainder of the original [a,c) span, [b,c), must not still
+	// resolve to the stale descriptor: its sibling range hasn't been
+	// reported, so a lookup for a key in it should miss and force a
+	// re-fault rather than silently returning the old, wider range's
+	// (now wrong) leader.
+	if _, ok := db.rangeCache.lookup(storage.Key("b")); ok {
+		t.Fatalf("range cache still serves the orphaned [b,c) remainder of the pre-split descriptor")
+	}
+}